@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// BanListFile is where the ban list is persisted so bans survive restarts.
+const BanListFile = "bans.json"
+
+// BanType is the dimension a ban applies to.
+type BanType string
+
+const (
+	BanIP          BanType = "ip"
+	BanNetworkCIDR BanType = "cidr"
+	BanName        BanType = "name"
+	BanFingerprint BanType = "fingerprint"
+)
+
+// Ban is a single entry in the BanList.
+type Ban struct {
+	Type      BanType   `json:"type"`
+	Value     string    `json:"value"`
+	Reason    string    `json:"reason"`
+	Admin     bool      `json:"admin"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (b Ban) expired(now time.Time) bool {
+	return now.After(b.ExpiresAt)
+}
+
+// BanList tracks bans across every dimension (IP, CIDR, name, fingerprint)
+// and persists them to disk so they survive a restart.
+type BanList struct {
+	bans []Ban
+	path string
+}
+
+// NewBanList loads bans from path, if it exists, and returns an empty list
+// otherwise.
+func NewBanList(path string) *BanList {
+	bl := &BanList{path: path}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return bl
+	}
+	if err := json.Unmarshal(data, &bl.bans); err != nil {
+		logger.Warn("could not parse ban list", zap.String("path", path), zap.Error(err))
+	}
+	return bl
+}
+
+func (bl *BanList) save() {
+	data, err := json.MarshalIndent(bl.bans, "", "  ")
+	if err != nil {
+		logger.Warn("could not marshal ban list", zap.Error(err))
+		return
+	}
+	if err := os.WriteFile(bl.path, data, 0644); err != nil {
+		logger.Warn("could not write ban list", zap.String("path", bl.path), zap.Error(err))
+	}
+}
+
+// Add records a new ban and persists the list.
+func (bl *BanList) Add(banType BanType, value string, duration time.Duration, reason string, admin bool) {
+	bl.bans = append(bl.bans, Ban{
+		Type:      banType,
+		Value:     value,
+		Reason:    reason,
+		Admin:     admin,
+		ExpiresAt: time.Now().Add(duration),
+	})
+	bl.save()
+}
+
+// Remove drops every ban matching banType+value and persists the list.
+func (bl *BanList) Remove(banType BanType, value string) {
+	kept := bl.bans[:0]
+	for _, b := range bl.bans {
+		if b.Type == banType && b.Value == value {
+			continue
+		}
+		kept = append(kept, b)
+	}
+	bl.bans = kept
+	bl.save()
+}
+
+// List returns the bans currently in effect, dropping (and persisting the
+// removal of) any that have expired.
+func (bl *BanList) List() []Ban {
+	now := time.Now()
+	active := bl.bans[:0]
+	changed := false
+	for _, b := range bl.bans {
+		if b.expired(now) {
+			changed = true
+			continue
+		}
+		active = append(active, b)
+	}
+	bl.bans = active
+	if changed {
+		bl.save()
+	}
+	return bl.bans
+}
+
+// Check looks up whether a connecting client matches any active ban
+// dimension, returning the first match.
+func (bl *BanList) Check(ip, name, fingerprint string) (Ban, bool) {
+	for _, b := range bl.List() {
+		switch b.Type {
+		case BanIP:
+			if b.Value == ip {
+				return b, true
+			}
+		case BanNetworkCIDR:
+			_, ipnet, err := net.ParseCIDR(b.Value)
+			if err == nil && ipnet.Contains(net.ParseIP(ip)) {
+				return b, true
+			}
+		case BanName:
+			if b.Value == name {
+				return b, true
+			}
+		case BanFingerprint:
+			if b.Value == fingerprint {
+				return b, true
+			}
+		}
+	}
+	return Ban{}, false
+}
+
+// Fingerprint hashes the name+IP tuple a client first connects with, used as
+// a stable identifier across reconnects with a different port.
+func Fingerprint(name, ip string) string {
+	sum := sha256.Sum256([]byte(name + "|" + ip))
+	return hex.EncodeToString(sum[:])
+}
+
+// Strikes tracks how many strikes each /24 CIDR has accrued, so HowToBan can
+// recommend a CIDR ban once several addresses in the same network misbehave.
+type Strikes struct {
+	byCIDR map[string]int
+}
+
+func NewStrikes() *Strikes {
+	return &Strikes{byCIDR: map[string]int{}}
+}
+
+func (s *Strikes) Record(ip string) {
+	if cidr := slash24(ip); cidr != "" {
+		s.byCIDR[cidr]++
+	}
+}
+
+func (s *Strikes) Count(ip string) int {
+	return s.byCIDR[slash24(ip)]
+}
+
+func slash24(ip string) string {
+	parsed := net.ParseIP(ip).To4()
+	if parsed == nil {
+		return ""
+	}
+	return fmt.Sprintf("%d.%d.%d.0/24", parsed[0], parsed[1], parsed[2])
+}
+
+// HowToBan inspects a live client's attributes and suggests the narrowest
+// effective ban: a name ban when its IP is shared with other known names, a
+// CIDR ban when several strikes have landed from the same /24, or otherwise
+// a plain IP ban.
+func HowToBan(clients map[string]*Client, strikes *Strikes, name string) (BanType, string, error) {
+	var target *Client
+	namesPerIP := map[string]map[string]bool{}
+	for _, c := range clients {
+		addr := c.Conn.RemoteAddr().(*net.TCPAddr)
+		ip := addr.IP.String()
+		if namesPerIP[ip] == nil {
+			namesPerIP[ip] = map[string]bool{}
+		}
+		namesPerIP[ip][c.Name] = true
+		if c.Name == name {
+			target = c
+		}
+	}
+	if target == nil {
+		return "", "", fmt.Errorf("no connected client named %q", name)
+	}
+	addr := target.Conn.RemoteAddr().(*net.TCPAddr)
+	ip := addr.IP.String()
+
+	if len(namesPerIP[ip]) > 1 {
+		return BanName, name, nil
+	}
+	if strikes.Count(ip) > 1 {
+		return BanNetworkCIDR, slash24(ip), nil
+	}
+	return BanIP, ip, nil
+}
+
+// parseAdminCommand recognizes the admin side-channel commands
+// (/ban, /unban, /banlist, /howtoban) in a chat line. ok is false when text
+// isn't an admin command at all.
+func parseAdminCommand(text string) (cmd string, args []string, ok bool) {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, "/") {
+		return "", nil, false
+	}
+	fields := strings.Fields(text)
+	switch fields[0] {
+	case "/ban", "/unban", "/banlist", "/howtoban", "/stats":
+		return fields[0], fields[1:], true
+	default:
+		return "", nil, false
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeConn is a minimal net.Conn stub with a fixed RemoteAddr, just enough
+// for BanList.Check and HowToBan (which only ever call RemoteAddr) without
+// needing a real socket.
+type fakeConn struct {
+	net.Conn
+	remote *net.TCPAddr
+}
+
+func newFakeConn(ip string) net.Conn {
+	return &fakeConn{remote: &net.TCPAddr{IP: net.ParseIP(ip)}}
+}
+
+func (f *fakeConn) RemoteAddr() net.Addr { return f.remote }
+
+func TestBanListCheckMatchesCIDR(t *testing.T) {
+	bl := NewBanList(t.TempDir() + "/bans.json")
+	bl.Add(BanNetworkCIDR, "10.0.0.0/24", time.Hour, "subnet abuse", true)
+
+	if _, banned := bl.Check("10.0.0.42", "anyone", "anyfp"); !banned {
+		t.Fatalf("expected 10.0.0.42 to match the 10.0.0.0/24 ban")
+	}
+	if _, banned := bl.Check("10.0.1.42", "anyone", "anyfp"); banned {
+		t.Fatalf("expected 10.0.1.42 (outside the /24) to not match")
+	}
+}
+
+func TestBanListCheckMatchesFingerprint(t *testing.T) {
+	bl := NewBanList(t.TempDir() + "/bans.json")
+	fp := Fingerprint("troll", "1.2.3.4")
+	bl.Add(BanFingerprint, fp, time.Hour, "repeat offender", true)
+
+	if _, banned := bl.Check("9.9.9.9", "troll", fp); !banned {
+		t.Fatalf("expected a fingerprint match even from a different IP")
+	}
+	if _, banned := bl.Check("1.2.3.4", "troll", Fingerprint("troll", "9.9.9.9")); banned {
+		t.Fatalf("expected a different fingerprint to not match")
+	}
+}
+
+func TestBanListExpiryIsPrunedAndPersisted(t *testing.T) {
+	path := t.TempDir() + "/bans.json"
+	bl := NewBanList(path)
+	bl.Add(BanIP, "1.1.1.1", -time.Second, "already expired", true)
+	bl.Add(BanIP, "2.2.2.2", time.Hour, "still active", true)
+
+	if _, banned := bl.Check("1.1.1.1", "", ""); banned {
+		t.Fatalf("expected the expired ban to no longer apply")
+	}
+
+	reloaded := NewBanList(path)
+	active := reloaded.List()
+	if len(active) != 1 || active[0].Value != "2.2.2.2" {
+		t.Fatalf("expected only the still-active ban to survive the reload, got %+v", active)
+	}
+}
+
+func TestHowToBanPrefersNameOverIPWhenShared(t *testing.T) {
+	clients := map[string]*Client{
+		"a": {Name: "alice", Conn: newFakeConn("1.2.3.4")},
+		"b": {Name: "bob", Conn: newFakeConn("1.2.3.4")},
+	}
+	banType, value, err := HowToBan(clients, NewStrikes(), "alice")
+	if err != nil {
+		t.Fatalf("HowToBan: %s", err)
+	}
+	if banType != BanName || value != "alice" {
+		t.Fatalf("got %s %s, want a name ban on alice (IP shared with bob)", banType, value)
+	}
+}
+
+func TestHowToBanPrefersCIDROverIPAfterRepeatStrikes(t *testing.T) {
+	clients := map[string]*Client{
+		"a": {Name: "alice", Conn: newFakeConn("1.2.3.4")},
+	}
+	strikes := NewStrikes()
+	strikes.Record("1.2.3.4")
+	strikes.Record("1.2.3.99") // another host in the same /24
+
+	banType, value, err := HowToBan(clients, strikes, "alice")
+	if err != nil {
+		t.Fatalf("HowToBan: %s", err)
+	}
+	if banType != BanNetworkCIDR || value != "1.2.3.0/24" {
+		t.Fatalf("got %s %s, want a /24 ban after repeat strikes from the same subnet", banType, value)
+	}
+}
+
+func TestHowToBanFallsBackToIP(t *testing.T) {
+	clients := map[string]*Client{
+		"a": {Name: "alice", Conn: newFakeConn("1.2.3.4")},
+	}
+	banType, value, err := HowToBan(clients, NewStrikes(), "alice")
+	if err != nil {
+		t.Fatalf("HowToBan: %s", err)
+	}
+	if banType != BanIP || value != "1.2.3.4" {
+		t.Fatalf("got %s %s, want a plain IP ban with no sharing or repeat strikes", banType, value)
+	}
+}
+
+func TestHowToBanUnknownClient(t *testing.T) {
+	if _, _, err := HowToBan(map[string]*Client{}, NewStrikes(), "nobody"); err == nil {
+		t.Fatalf("expected an error for a name with no connected client")
+	}
+}
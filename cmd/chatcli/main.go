@@ -0,0 +1,59 @@
+// Command chatcli is a minimal standalone client for the framed chat
+// protocol implemented by package frame: it sends a Hello frame with the
+// configured name, then relays stdin lines as Chat frames and prints
+// incoming Chat frames to stdout.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+
+	"github.com/KartikSindura/chat/frame"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:6969", "server address")
+	name := flag.String("name", "anon", "name to announce with")
+	flag.Parse()
+
+	conn, err := net.Dial("tcp", *addr)
+	if err != nil {
+		log.Fatalf("could not connect to %s: %s\n", *addr, err)
+	}
+	defer conn.Close()
+
+	fw := frame.NewWriter(conn)
+	if err := fw.WriteFrame(frame.Hello, []byte(*name)); err != nil {
+		log.Fatalf("could not send Hello frame: %s\n", err)
+	}
+
+	go readLoop(conn)
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		if err := fw.WriteFrame(frame.Chat, scanner.Bytes()); err != nil {
+			log.Fatalf("could not send message: %s\n", err)
+		}
+	}
+}
+
+func readLoop(conn net.Conn) {
+	fr := frame.NewReader(conn)
+	for {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			log.Fatalf("disconnected: %s\n", err)
+		}
+		switch f.Type {
+		case frame.Chat:
+			fmt.Println(string(f.Payload))
+		case frame.Bye:
+			log.Println("server closed the connection")
+			os.Exit(0)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+// Package frame implements the chat server's length-prefixed wire format:
+// each frame is [uint8 type][uint16 big-endian length][payload], with large
+// payloads transparently gzip-compressed and flagged via the type byte.
+package frame
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Type identifies what a frame carries.
+type Type uint8
+
+const (
+	Hello Type = iota + 1
+	Chat
+	Ping
+	Pong
+	Bye
+)
+
+// compressedBit is OR'd into a frame's type byte when its payload is
+// gzip-compressed; Type() below strips it back off.
+const compressedBit Type = 0x80
+
+// Type returns the frame kind with the compression flag stripped off.
+func (t Type) Type() Type {
+	return t &^ compressedBit
+}
+
+// MaxFrameSize bounds both the declared length on the wire and the size of
+// an inflated payload, so a malicious length or compression ratio can't be
+// used to force an unbounded allocation. It must stay well under the
+// uint16 length field's range so an oversized declared length is actually
+// rejectable.
+const MaxFrameSize = 16 * 1024
+
+// CompressThreshold is the payload size above which Writer gzips a frame.
+const CompressThreshold = 512
+
+// ErrFrameTooLarge is returned when a frame's declared or inflated size
+// exceeds MaxFrameSize.
+var ErrFrameTooLarge = errors.New("frame: payload exceeds max frame size")
+
+// Frame is one decoded unit of the wire protocol.
+type Frame struct {
+	Type    Type
+	Payload []byte
+}
+
+// Reader decodes frames from an underlying io.Reader, handling partial
+// reads and transparently inflating gzip-compressed payloads.
+type Reader struct {
+	r io.Reader
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// ReadFrame blocks until one full frame has been read from the underlying
+// reader, or returns the error that prevented that (including
+// ErrFrameTooLarge for an oversized frame).
+func (fr *Reader) ReadFrame() (Frame, error) {
+	var header [3]byte
+	if _, err := io.ReadFull(fr.r, header[:]); err != nil {
+		return Frame{}, err
+	}
+	typ := Type(header[0])
+	length := binary.BigEndian.Uint16(header[1:3])
+	if int(length) > MaxFrameSize {
+		// Drain the declared payload before reporting the error, so the
+		// stream stays in sync for whatever frame follows it instead of
+		// leaving the next header read starting mid-payload.
+		if _, err := io.CopyN(io.Discard, fr.r, int64(length)); err != nil {
+			return Frame{}, err
+		}
+		return Frame{}, ErrFrameTooLarge
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(fr.r, payload); err != nil {
+		return Frame{}, err
+	}
+
+	if typ&compressedBit != 0 {
+		inflated, err := inflate(payload)
+		if err != nil {
+			return Frame{}, err
+		}
+		payload = inflated
+	}
+
+	return Frame{Type: typ.Type(), Payload: payload}, nil
+}
+
+func inflate(payload []byte) ([]byte, error) {
+	gr, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("frame: could not open gzip payload: %w", err)
+	}
+	defer gr.Close()
+
+	inflated, err := io.ReadAll(io.LimitReader(gr, MaxFrameSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("frame: could not inflate payload: %w", err)
+	}
+	if len(inflated) > MaxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+	return inflated, nil
+}
+
+// Writer encodes frames to an underlying io.Writer, gzip-compressing any
+// payload larger than CompressThreshold (and only keeping the compressed
+// form if it actually came out smaller).
+type Writer struct {
+	w io.Writer
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// WriteFrame encodes and writes a single frame.
+func (fw *Writer) WriteFrame(typ Type, payload []byte) error {
+	if len(payload) > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+
+	if len(payload) > CompressThreshold {
+		if compressed, ok := deflate(payload); ok {
+			typ |= compressedBit
+			payload = compressed
+		}
+	}
+
+	var header [3]byte
+	header[0] = byte(typ)
+	binary.BigEndian.PutUint16(header[1:3], uint16(len(payload)))
+	if _, err := fw.w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := fw.w.Write(payload)
+	return err
+}
+
+// deflate gzip-compresses payload, returning ok=false if that didn't
+// actually shrink it (not worth the CPU or the flag bit).
+func deflate(payload []byte) (compressed []byte, ok bool) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(payload); err != nil {
+		return nil, false
+	}
+	if err := gw.Close(); err != nil {
+		return nil, false
+	}
+	if buf.Len() >= len(payload) {
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
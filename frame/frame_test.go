@@ -0,0 +1,76 @@
+package frame
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteReadRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	if err := w.WriteFrame(Chat, []byte("hello")); err != nil {
+		t.Fatalf("WriteFrame: %s", err)
+	}
+
+	r := NewReader(&buf)
+	f, err := r.ReadFrame()
+	if err != nil {
+		t.Fatalf("ReadFrame: %s", err)
+	}
+	if f.Type != Chat || string(f.Payload) != "hello" {
+		t.Fatalf("got %+v, want Chat frame with payload %q", f, "hello")
+	}
+}
+
+func TestLargePayloadIsCompressedAndInflatesBack(t *testing.T) {
+	payload := []byte(strings.Repeat("a", CompressThreshold*2))
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	if err := w.WriteFrame(Chat, payload); err != nil {
+		t.Fatalf("WriteFrame: %s", err)
+	}
+	if buf.Len() >= len(payload) {
+		t.Fatalf("expected the highly compressible payload to shrink on the wire, wire size %d, payload size %d", buf.Len(), len(payload))
+	}
+
+	r := NewReader(&buf)
+	f, err := r.ReadFrame()
+	if err != nil {
+		t.Fatalf("ReadFrame: %s", err)
+	}
+	if !bytes.Equal(f.Payload, payload) {
+		t.Fatalf("inflated payload did not round-trip")
+	}
+}
+
+func TestOversizedDeclaredLengthIsRejectedAndDrained(t *testing.T) {
+	var buf bytes.Buffer
+	var header [3]byte
+	header[0] = byte(Chat)
+	header[1] = 0xff
+	header[2] = 0xff // declares a 65535-byte payload, over MaxFrameSize
+	buf.Write(header[:])
+	buf.Write(make([]byte, 0xffff)) // the declared (garbage) payload itself
+
+	w := NewWriter(&buf)
+	if err := w.WriteFrame(Chat, []byte("next")); err != nil {
+		t.Fatalf("WriteFrame: %s", err)
+	}
+
+	r := NewReader(&buf)
+	if _, err := r.ReadFrame(); err != ErrFrameTooLarge {
+		t.Fatalf("got err %v, want ErrFrameTooLarge", err)
+	}
+
+	// The oversized payload must be fully drained so the next frame is
+	// read from the right offset instead of from its middle.
+	f, err := r.ReadFrame()
+	if err != nil {
+		t.Fatalf("ReadFrame after oversized frame: %s", err)
+	}
+	if f.Type != Chat || string(f.Payload) != "next" {
+		t.Fatalf("got %+v, want the following Chat frame with payload %q", f, "next")
+	}
+}
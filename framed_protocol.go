@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/KartikSindura/chat/frame"
+)
+
+// FramedProtocol speaks the length-prefixed, optionally gzip-compressed
+// frame format implemented by package frame, replacing the old "one Read
+// call is one message" assumption with a real framing layer.
+type FramedProtocol struct{}
+
+func (FramedProtocol) Handshake(r *bufio.Reader, conn net.Conn) (string, error) {
+	fr := frame.NewReader(r)
+	f, err := fr.ReadFrame()
+	if err != nil {
+		return "", err
+	}
+	if f.Type != frame.Hello {
+		return "", fmt.Errorf("framed: expected a Hello frame, got type %d", f.Type)
+	}
+	return cleanName(string(f.Payload)), nil
+}
+
+func (FramedProtocol) Decode(r *bufio.Reader) (Command, error) {
+	fr := frame.NewReader(r)
+	f, err := fr.ReadFrame()
+	if err != nil {
+		return Command{}, err
+	}
+	switch f.Type {
+	case frame.Chat:
+		return Command{Kind: CmdChat, Text: string(f.Payload)}, nil
+	case frame.Ping:
+		return Command{Kind: CmdPing}, nil
+	case frame.Pong:
+		return Command{Kind: CmdPong}, nil
+	case frame.Bye:
+		return Command{Kind: CmdQuit}, nil
+	default:
+		return Command{}, fmt.Errorf("framed: unsupported frame type %d", f.Type)
+	}
+}
+
+func (FramedProtocol) Encode(w io.Writer, reply Reply) error {
+	fw := frame.NewWriter(w)
+	typ := frame.Chat
+	if reply.Text == "PONG" && reply.From == "" && reply.Channel == "" {
+		typ = frame.Pong
+	}
+	return fw.WriteFrame(typ, []byte(reply.Text))
+}
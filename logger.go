@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// LoggerConfig picks how the structured logger is built.
+type LoggerConfig struct {
+	Dev      bool   // console encoding instead of JSON, for local development
+	LogLevel string // "debug", "info", "warn", "error"
+	Debug    bool   // log every inbound/outbound message payload
+}
+
+// New builds the process-wide zap.Logger: JSON output for production,
+// console for dev, level taken from cfg.LogLevel.
+func New(cfg LoggerConfig) (*zap.Logger, error) {
+	level := zapcore.InfoLevel
+	if err := level.Set(cfg.LogLevel); err != nil {
+		return nil, err
+	}
+
+	var zapCfg zap.Config
+	if cfg.Dev {
+		zapCfg = zap.NewDevelopmentConfig()
+	} else {
+		zapCfg = zap.NewProductionConfig()
+	}
+	zapCfg.Level = zap.NewAtomicLevelAt(level)
+	return zapCfg.Build()
+}
+
+// redactedAddr wraps a net.Addr so that logging it honours SafeMode,
+// redacting the address field-by-field rather than the whole log line.
+type redactedAddr struct {
+	addr net.Addr
+}
+
+func redactAddr(addr net.Addr) redactedAddr {
+	return redactedAddr{addr: addr}
+}
+
+func (r redactedAddr) String() string {
+	if SafeMode {
+		return "[REDACTED]"
+	}
+	return r.addr.String()
+}
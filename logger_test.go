@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// tcpConnPair returns a connected server/client pair of real TCP conns, so
+// RemoteAddr().(*net.TCPAddr) behaves the same way it does in production.
+func tcpConnPair(t *testing.T) (serverSide, clientSide net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	clientSide, err = net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	return <-accepted, clientSide
+}
+
+func withObservedLogger(t *testing.T) *observer.ObservedLogs {
+	t.Helper()
+	core, logs := observer.New(zap.InfoLevel)
+	prev := logger
+	logger = zap.New(core)
+	t.Cleanup(func() { logger = prev })
+	return logs
+}
+
+func TestServerLogsConnectAndDisconnect(t *testing.T) {
+	logs := withObservedLogger(t)
+
+	conn, clientSide := tcpConnPair(t)
+	defer clientSide.Close()
+
+	banList := NewBanList(t.TempDir() + "/bans.json")
+	messages := make(chan Message, 4)
+	var wg sync.WaitGroup
+	go server(messages, banList, NewStrikes(), AdminConfig{IPs: map[string]bool{}}, &wg, NewRateLimiter())
+
+	messages <- Message{Type: ClientConnected, Conn: conn, Name: "alice", Protocol: RawProtocol{}}
+	messages <- Message{Type: ClientDisconnected, Conn: conn}
+	time.Sleep(50 * time.Millisecond)
+
+	entries := logs.All()
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 log entries, got %d: %+v", len(entries), entries)
+	}
+	if entries[0].Message != "client connected" {
+		t.Errorf("expected a connect log first, got %q", entries[0].Message)
+	}
+	if name := entries[0].ContextMap()["name"]; name != "alice" {
+		t.Errorf("expected name field %q, got %+v", "alice", entries[0].ContextMap())
+	}
+	if entries[1].Message != "client disconnected" {
+		t.Errorf("expected a disconnect log second, got %q", entries[1].Message)
+	}
+}
+
+func TestServerDoesNotLogConnectForBannedClient(t *testing.T) {
+	logs := withObservedLogger(t)
+
+	conn, clientSide := tcpConnPair(t)
+	defer clientSide.Close()
+
+	banList := NewBanList(t.TempDir() + "/bans.json")
+	banList.Add(BanIP, conn.RemoteAddr().(*net.TCPAddr).IP.String(), time.Minute, "test ban", true)
+
+	messages := make(chan Message, 1)
+	var wg sync.WaitGroup
+	go server(messages, banList, NewStrikes(), AdminConfig{IPs: map[string]bool{}}, &wg, NewRateLimiter())
+	messages <- Message{Type: ClientConnected, Conn: conn, Name: "bob", Protocol: RawProtocol{}}
+	time.Sleep(50 * time.Millisecond)
+
+	for _, e := range logs.All() {
+		if e.Message == "client connected" {
+			t.Fatalf("a banned client should not produce a connect log")
+		}
+	}
+}
+
+func TestServerLogsBanOnStrikeLimit(t *testing.T) {
+	logs := withObservedLogger(t)
+
+	conn, clientSide := tcpConnPair(t)
+	defer clientSide.Close()
+
+	banList := NewBanList(t.TempDir() + "/bans.json")
+	messages := make(chan Message, StrikeLimit+4)
+	var wg sync.WaitGroup
+	go server(messages, banList, NewStrikes(), AdminConfig{IPs: map[string]bool{}}, &wg, NewRateLimiter())
+
+	messages <- Message{Type: ClientConnected, Conn: conn, Name: "troll", Protocol: RawProtocol{}}
+	invalidUTF8 := string([]byte{0xff, 0xfe})
+	for i := 0; i <= StrikeLimit; i++ {
+		messages <- Message{Type: NewMessage, Conn: conn, Cmd: Command{Kind: CmdChat, Text: invalidUTF8}}
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	var found bool
+	for _, e := range logs.All() {
+		if e.Message != "client banned" {
+			continue
+		}
+		found = true
+		if typ := e.ContextMap()["type"]; typ != string(BanIP) {
+			t.Errorf("expected type %q, got %+v", BanIP, e.ContextMap())
+		}
+		if isAdmin := e.ContextMap()["admin"]; isAdmin != false {
+			t.Errorf("expected admin false for a strike-triggered ban, got %+v", e.ContextMap())
+		}
+	}
+	if !found {
+		t.Fatalf("expected a ban log entry after exceeding the strike limit, got %+v", logs.All())
+	}
+}
+
+func TestServerLogsBanOnAdminCommand(t *testing.T) {
+	logs := withObservedLogger(t)
+
+	conn, clientSide := tcpConnPair(t)
+	defer clientSide.Close()
+
+	banList := NewBanList(t.TempDir() + "/bans.json")
+	messages := make(chan Message, 4)
+	var wg sync.WaitGroup
+	go server(messages, banList, NewStrikes(), AdminConfig{Token: "root"}, &wg, NewRateLimiter())
+
+	messages <- Message{Type: ClientConnected, Conn: conn, Name: "root", Protocol: RawProtocol{}}
+	messages <- Message{Type: NewMessage, Conn: conn, Cmd: Command{Kind: CmdChat, Text: "/ban ip 9.9.9.9 1h abuse"}}
+	time.Sleep(50 * time.Millisecond)
+
+	var found bool
+	for _, e := range logs.All() {
+		if e.Message != "client banned" {
+			continue
+		}
+		found = true
+		if isAdmin := e.ContextMap()["admin"]; isAdmin != true {
+			t.Errorf("expected admin true for an admin-issued ban, got %+v", e.ContextMap())
+		}
+		if value := e.ContextMap()["value"]; value != "[REDACTED]" {
+			t.Errorf("expected the banned value to be redacted under SafeMode, got %+v", e.ContextMap())
+		}
+	}
+	if !found {
+		t.Fatalf("expected a ban log entry for an admin /ban command, got %+v", logs.All())
+	}
+}
@@ -1,21 +1,60 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
 	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 	"unicode/utf8"
+
+	"go.uber.org/zap"
+
+	"github.com/KartikSindura/chat/frame"
 )
 
+// ShutdownTimeout bounds how long main() waits for client read/write
+// goroutines to drain once a shutdown has been requested.
+const ShutdownTimeout = 5 * time.Second
+
+// logger is the process-wide structured logger, replaced in main() once
+// flags are parsed. It defaults to a no-op so code paths exercised from
+// tests don't need to build a real one.
+var logger = zap.NewNop()
+
+// debugMode, when set via -debug, makes every inbound/outbound message
+// payload get logged at debug level with its length and UTF-8 validity.
+var debugMode = false
+
 const (
 	SafeMode    = true
 	Port        = "6969"
-	MessageRate = 1.0
 	BanLimit    = 10.0
 	StrikeLimit = 10
 )
 
+// AdminConfig says who is allowed to issue /ban, /unban, /banlist and
+// /howtoban commands: clients connecting from one of AdminIPs, or whose
+// name happens to equal AdminToken.
+type AdminConfig struct {
+	IPs   map[string]bool
+	Token string
+}
+
+func (a AdminConfig) allows(author *Client, addr *net.TCPAddr) bool {
+	if a.IPs[addr.IP.String()] {
+		return true
+	}
+	return a.Token != "" && author.Name == a.Token
+}
+
 func sensitive(message string) string {
 	if SafeMode {
 		return "[REDACTED]"
@@ -24,141 +63,470 @@ func sensitive(message string) string {
 	}
 }
 
+func cleanName(name string) string {
+	trimmed := name
+	for len(trimmed) > 0 && (trimmed[len(trimmed)-1] == '\n' || trimmed[len(trimmed)-1] == '\r' || trimmed[len(trimmed)-1] == ' ') {
+		trimmed = trimmed[:len(trimmed)-1]
+	}
+	if utf8.ValidString(trimmed) && trimmed != "" {
+		return trimmed
+	}
+	return "anon"
+}
+
 type MessageType int
 
 const (
 	ClientConnected MessageType = iota + 1
 	NewMessage
 	ClientDisconnected
+	ServerShutdown
+	// ClientProtocolError carries a recoverable *ProtocolError from
+	// Decode: the client stays connected and gets a numeric reply instead
+	// of being dropped.
+	ClientProtocolError
+	// ClientOversizedFrame marks a frame rejected for exceeding
+	// frame.MaxFrameSize; handled like any other rule violation, via
+	// strike(), rather than a silent disconnect.
+	ClientOversizedFrame
 )
 
+// Message is what client() goroutines hand to server() over the messages
+// channel. ClientConnected carries Name/Protocol; NewMessage carries the
+// decoded Cmd; ClientProtocolError carries Err.
 type Message struct {
-	Type MessageType
-	Conn net.Conn
-	Text string
+	Type     MessageType
+	Conn     net.Conn
+	Name     string
+	Protocol Protocol
+	Cmd      Command
+	Err      *ProtocolError
 }
 
+// Client is a connected peer, abstracted over whatever Protocol it speaks
+// and the set of channels it has joined. Writes never touch Conn directly:
+// send() hands encoded bytes to writebuffer, which a dedicated goroutine
+// (started alongside the client) drains, so one slow reader can't block
+// the server goroutine that's trying to write to it.
 type Client struct {
+	Name        string
 	Conn        net.Conn
-	LastMessage time.Time
+	Protocol    Protocol
+	Channels    map[string]bool
 	StrikeCount int
+	writebuffer chan []byte
+	closeOnce   sync.Once
+}
+
+func (c *Client) send(reply Reply) {
+	if debugMode {
+		logger.Debug("sending reply", zap.Int("bytes", len(reply.Text)), zap.Bool("valid_utf8", utf8.ValidString(reply.Text)))
+	}
+	var buf bytes.Buffer
+	if err := c.Protocol.Encode(&buf, reply); err != nil {
+		logger.Warn("could not encode reply for client", zap.Stringer("addr", redactAddr(c.Conn.RemoteAddr())), zap.Error(err))
+		return
+	}
+	select {
+	case c.writebuffer <- buf.Bytes():
+	default:
+		logger.Warn("write buffer full, dropping message", zap.Stringer("addr", redactAddr(c.Conn.RemoteAddr())))
+	}
+}
+
+// closeConn closes the writebuffer, letting writerLoop drain whatever's
+// still queued (including a CloseWith farewell) and close the connection
+// itself once it's done. A client that was rejected before it ever got a
+// writebuffer/writerLoop (no slot in clients yet) has its connection
+// closed directly instead. Safe to call more than once.
+func (c *Client) closeConn() {
+	c.closeOnce.Do(func() {
+		if c.writebuffer == nil {
+			c.Conn.Close()
+			return
+		}
+		close(c.writebuffer)
+	})
+}
+
+// CloseWith enqueues a final message onto writebuffer rather than writing
+// it to the connection directly, so it can never interleave with whatever
+// writerLoop is mid-write on, then closes the client. Used uniformly by
+// the ban, strike-out and shutdown paths.
+func (c *Client) CloseWith(reason string) {
+	var buf bytes.Buffer
+	if err := c.Protocol.Encode(&buf, Reply{Text: reason}); err == nil {
+		if c.writebuffer == nil {
+			c.Conn.Write(buf.Bytes())
+		} else {
+			select {
+			case c.writebuffer <- buf.Bytes():
+			default:
+				logger.Warn("write buffer full, dropping farewell message", zap.Stringer("addr", redactAddr(c.Conn.RemoteAddr())))
+			}
+		}
+	}
+	c.closeConn()
 }
 
-type BannedMf struct {
+// writerLoop drains a client's writebuffer to its connection until the
+// buffer is closed, then closes the connection itself (so nothing else
+// ever writes to or closes it concurrently) and marks the client's slot
+// in wg done.
+func writerLoop(c *Client, wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer c.Conn.Close()
+	for payload := range c.writebuffer {
+		if _, err := c.Conn.Write(payload); err != nil {
+			logger.Warn("could not flush write buffer", zap.Stringer("addr", redactAddr(c.Conn.RemoteAddr())), zap.Error(err))
+		}
+	}
 }
 
-func server(messages chan Message) {
+func server(messages chan Message, banList *BanList, strikes *Strikes, admin AdminConfig, wg *sync.WaitGroup, rateLimiter *RateLimiter) {
 	clients := map[string]*Client{}
-	bannedMfs := map[string]time.Time{}
+	gcTicker := time.NewTicker(time.Minute)
+	defer gcTicker.Stop()
 	for {
-		msg := <-messages
-		switch msg.Type {
-		case ClientConnected:
-			addr := msg.Conn.RemoteAddr().(*net.TCPAddr)
-			bannedAt, banned := bannedMfs[addr.IP.String()]
-			now := time.Now()
-			if banned {
-				if now.Sub(bannedAt).Seconds() >= BanLimit {
-					delete(bannedMfs, addr.IP.String())
-					banned = false
-				}
-			}
+		select {
+		case <-gcTicker.C:
+			rateLimiter.GC()
+			continue
+		case msg := <-messages:
+			handleMessage(msg, clients, banList, strikes, admin, wg, rateLimiter)
+		}
+	}
+}
 
-			if !banned {
-				clients[msg.Conn.RemoteAddr().String()] = &Client{
-					Conn:        msg.Conn,
-					LastMessage: time.Now(),
-				}
-				log.Printf("Client %s connected\n", sensitive(addr.IP.String()))
-			} else {
-				msg.Conn.Write([]byte(fmt.Sprintf("You are banned buddy: %f seconds left\n", BanLimit-now.Sub(bannedAt).Seconds())))
-				msg.Conn.Close()
-			}
-		case ClientDisconnected:
-			addr := msg.Conn.RemoteAddr().(*net.TCPAddr)
+func handleMessage(msg Message, clients map[string]*Client, banList *BanList, strikes *Strikes, admin AdminConfig, wg *sync.WaitGroup, rateLimiter *RateLimiter) {
+	switch msg.Type {
+	case ClientConnected:
+		addr := msg.Conn.RemoteAddr().(*net.TCPAddr)
+		ip := addr.IP.String()
+		fingerprint := Fingerprint(msg.Name, ip)
+		if ban, banned := banList.Check(ip, msg.Name, fingerprint); banned {
+			rejected := &Client{Conn: msg.Conn, Protocol: msg.Protocol}
+			rejected.CloseWith(fmt.Sprintf("You are banned: %s (expires %s)", ban.Reason, ban.ExpiresAt.Format(time.RFC3339)))
+			return
+		}
+		if !rateLimiter.Connect(ip) {
+			rejected := &Client{Conn: msg.Conn, Protocol: msg.Protocol}
+			rejected.CloseWith(fmt.Sprintf("Too many connections from your IP (max %d)", MaxConnectionsPerIP))
+			return
+		}
+
+		newClient := &Client{
+			Name:        msg.Name,
+			Conn:        msg.Conn,
+			Protocol:    msg.Protocol,
+			Channels:    map[string]bool{},
+			writebuffer: make(chan []byte, 16),
+		}
+		clients[msg.Conn.RemoteAddr().String()] = newClient
+		wg.Add(1)
+		go writerLoop(newClient, wg)
+		logger.Info("client connected", zap.String("name", msg.Name), zap.Stringer("addr", redactAddr(addr)))
+	case ClientDisconnected:
+		addr := msg.Conn.RemoteAddr().(*net.TCPAddr)
+		if client, ok := clients[addr.String()]; ok {
+			client.closeConn()
 			delete(clients, addr.String())
-			log.Printf("Client %s disconnected\n", sensitive(addr.String()))
-		case NewMessage:
-			now := time.Now()
-			authorAddr := msg.Conn.RemoteAddr().(*net.TCPAddr)
-			author, authorExists := clients[authorAddr.String()]
-			if authorExists {
-				if now.Sub(author.LastMessage).Seconds() >= MessageRate {
-					if utf8.ValidString(msg.Text) {
-						author.StrikeCount = 0
-						author.LastMessage = now
-						log.Printf("Client %s sent: %s", sensitive(authorAddr.String()), msg.Text)
-						for _, client := range clients {
-							if client.Conn.RemoteAddr().String() != authorAddr.String() {
-								_, err := client.Conn.Write([]byte(msg.Text))
-								if err != nil {
-									log.Printf("could not send data to %s: %s\n", sensitive(client.Conn.RemoteAddr().String()), sensitive(err.Error()))
-								}
-							}
-						}
-					} else {
-						author.StrikeCount++
-						if author.StrikeCount > StrikeLimit {
-							bannedMfs[authorAddr.IP.String()] = now
-							author.Conn.Close()
-						}
-					}
-				} else {
-					author.StrikeCount++
-					if author.StrikeCount > StrikeLimit {
-						bannedMfs[authorAddr.IP.String()] = now
-						author.Conn.Close()
-					}
+			rateLimiter.Disconnect(addr.IP.String())
+		}
+		logger.Info("client disconnected", zap.Stringer("addr", redactAddr(addr)))
+	case ServerShutdown:
+		for _, client := range clients {
+			client.CloseWith("Server shutting down, reconnect later")
+		}
+		// Keep looping: read goroutines whose conn we just closed will
+		// still send a ClientDisconnected for us to drain, and we need
+		// to be around to do that so their wg.Done() isn't blocked.
+	case ClientProtocolError:
+		addr := msg.Conn.RemoteAddr().(*net.TCPAddr)
+		if author, ok := clients[addr.String()]; ok {
+			author.send(Reply{Numeric: msg.Err.Numeric, Text: msg.Err.Text})
+		}
+	case ClientOversizedFrame:
+		addr := msg.Conn.RemoteAddr().(*net.TCPAddr)
+		if author, ok := clients[addr.String()]; ok {
+			strike(banList, strikes, author, addr, time.Now())
+		}
+	case NewMessage:
+		authorAddr := msg.Conn.RemoteAddr().(*net.TCPAddr)
+		author, authorExists := clients[authorAddr.String()]
+		if !authorExists {
+			msg.Conn.Close()
+			return
+		}
+
+		switch msg.Cmd.Kind {
+		case CmdJoin:
+			author.Channels[msg.Cmd.Channel] = true
+			author.send(Reply{Numeric: 353, Text: fmt.Sprintf("%s :%s", msg.Cmd.Channel, namesIn(clients, msg.Cmd.Channel))})
+			author.send(Reply{Numeric: 366, Text: fmt.Sprintf("%s :End of /NAMES list", msg.Cmd.Channel)})
+		case CmdPart:
+			delete(author.Channels, msg.Cmd.Channel)
+		case CmdPing:
+			author.send(Reply{Text: "PONG"})
+		case CmdPong:
+			// no-op, just keeps the connection alive
+		case CmdNames:
+			author.send(Reply{Numeric: 353, Text: fmt.Sprintf("%s :%s", msg.Cmd.Channel, namesIn(clients, msg.Cmd.Channel))})
+		case CmdWallops:
+			for _, client := range clients {
+				client.send(Reply{From: author.Name, Text: msg.Cmd.Text})
+			}
+		case CmdQuit:
+			author.CloseWith("Bye!")
+		case CmdChat:
+			if cmdName, args, ok := parseAdminCommand(msg.Cmd.Text); ok {
+				if !admin.allows(author, authorAddr) {
+					author.send(Reply{Text: "you are not an admin"})
+					return
 				}
-			} else {
-				msg.Conn.Close()
+				author.send(Reply{Text: runAdminCommand(clients, banList, strikes, rateLimiter, cmdName, args)})
+				return
 			}
+			if !rateLimiter.Allow(authorAddr.IP.String()) {
+				strike(banList, strikes, author, authorAddr, time.Now())
+				return
+			}
+			if !utf8.ValidString(msg.Cmd.Text) {
+				strike(banList, strikes, author, authorAddr, time.Now())
+				return
+			}
+			author.StrikeCount = 0
+			logger.Info("client sent message", zap.Stringer("addr", redactAddr(authorAddr)), zap.String("text", msg.Cmd.Text))
+			broadcast(clients, author, msg.Cmd.Channel, msg.Cmd.Text)
 		}
 	}
 }
 
-func client(conn net.Conn, messages chan Message) {
-	buf := make([]byte, 512)
+// strike records a rule violation and bans the offending IP once it has
+// accumulated more than StrikeLimit of them.
+func strike(banList *BanList, strikes *Strikes, author *Client, addr *net.TCPAddr, now time.Time) {
+	author.StrikeCount++
+	if author.StrikeCount > StrikeLimit {
+		ip := addr.IP.String()
+		strikes.Record(ip)
+		reason := "exceeded strike limit"
+		banList.Add(BanIP, ip, time.Duration(BanLimit)*time.Second, reason, false)
+		logger.Info("client banned", zap.String("type", string(BanIP)), zap.String("value", sensitive(ip)), zap.String("reason", reason), zap.Bool("admin", false))
+		author.CloseWith("You have been banned for exceeding the strike limit")
+	}
+}
+
+// runAdminCommand executes a /ban, /unban, /banlist, /howtoban or /stats
+// command already known to come from an authorized admin, returning the
+// line to send back to them.
+func runAdminCommand(clients map[string]*Client, banList *BanList, strikes *Strikes, rateLimiter *RateLimiter, cmd string, args []string) string {
+	switch cmd {
+	case "/ban":
+		if len(args) < 4 {
+			return "usage: /ban <type> <value> <duration> <reason>"
+		}
+		duration, err := time.ParseDuration(args[2])
+		if err != nil {
+			return fmt.Sprintf("invalid duration %q: %s", args[2], err)
+		}
+		reason := strings.Join(args[3:], " ")
+		banList.Add(BanType(args[0]), args[1], duration, reason, true)
+		logger.Info("client banned", zap.String("type", args[0]), zap.String("value", sensitive(args[1])), zap.String("reason", reason), zap.Bool("admin", true))
+		return fmt.Sprintf("banned %s %s for %s: %s", args[0], args[1], duration, reason)
+	case "/unban":
+		if len(args) < 2 {
+			return "usage: /unban <type> <value>"
+		}
+		banList.Remove(BanType(args[0]), args[1])
+		return fmt.Sprintf("unbanned %s %s", args[0], args[1])
+	case "/banlist":
+		var lines []string
+		for _, b := range banList.List() {
+			lines = append(lines, fmt.Sprintf("%s %s expires %s: %s", b.Type, b.Value, b.ExpiresAt.Format(time.RFC3339), b.Reason))
+		}
+		if len(lines) == 0 {
+			return "ban list is empty"
+		}
+		return strings.Join(lines, "\n")
+	case "/howtoban":
+		if len(args) < 1 {
+			return "usage: /howtoban <name>"
+		}
+		banType, value, err := HowToBan(clients, strikes, args[0])
+		if err != nil {
+			return err.Error()
+		}
+		return fmt.Sprintf("suggested: /ban %s %s", banType, value)
+	case "/stats":
+		trackedIPs, connections := rateLimiter.Stats()
+		return fmt.Sprintf("%d clients connected, %d IPs tracked by the rate limiter, %d connections counted against the per-IP cap", len(clients), trackedIPs, connections)
+	default:
+		return fmt.Sprintf("unknown admin command %q", cmd)
+	}
+}
+
+// broadcast sends text to every other client in channel, or to every other
+// client period when channel is empty (plain, non-IRC chat).
+func broadcast(clients map[string]*Client, author *Client, channel, text string) {
+	for _, client := range clients {
+		if client == author {
+			continue
+		}
+		if channel != "" && !client.Channels[channel] {
+			continue
+		}
+		client.send(Reply{From: author.Name, Channel: channel, Text: text})
+	}
+}
+
+func namesIn(clients map[string]*Client, channel string) string {
+	names := ""
+	for _, client := range clients {
+		if client.Channels[channel] {
+			if names != "" {
+				names += " "
+			}
+			names += client.Name
+		}
+	}
+	return names
+}
+
+func client(conn net.Conn, messages chan Message, defaultProtocol Protocol, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	r := bufio.NewReader(conn)
+	protocol, err := detectProtocol(conn, r, defaultProtocol)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	name, err := protocol.Handshake(r, conn)
+	if err != nil {
+		logger.Warn("could not complete handshake", zap.Stringer("addr", redactAddr(conn.RemoteAddr())), zap.Error(err))
+		conn.Close()
+		return
+	}
+
+	messages <- Message{
+		Type:     ClientConnected,
+		Conn:     conn,
+		Name:     name,
+		Protocol: protocol,
+	}
+
 	for {
-		n, err := conn.Read(buf)
+		cmd, err := protocol.Decode(r)
 		if err != nil {
-			log.Printf("could not read from %s: %s\n", sensitive(conn.RemoteAddr().String()), sensitive(err.Error()))
-			conn.Close()
+			var protoErr *ProtocolError
+			if errors.As(err, &protoErr) {
+				messages <- Message{Type: ClientProtocolError, Conn: conn, Err: protoErr}
+				continue
+			}
+			if errors.Is(err, frame.ErrFrameTooLarge) {
+				messages <- Message{Type: ClientOversizedFrame, Conn: conn}
+				continue
+			}
+			logger.Warn("could not read from client", zap.Stringer("addr", redactAddr(conn.RemoteAddr())), zap.Error(err))
 			messages <- Message{
 				Type: ClientDisconnected,
 				Conn: conn,
 			}
 			return
 		}
+		if debugMode {
+			logger.Debug("decoded command", zap.Int("kind", int(cmd.Kind)), zap.Int("bytes", len(cmd.Text)), zap.Bool("valid_utf8", utf8.ValidString(cmd.Text)))
+		}
 		messages <- Message{
 			Type: NewMessage,
-			Text: string(buf[0:n]),
 			Conn: conn,
+			Cmd:  cmd,
 		}
 	}
 }
 
+func defaultProtocolFor(name string) Protocol {
+	switch name {
+	case "irc":
+		return NewIRCProtocol()
+	case "framed":
+		return FramedProtocol{}
+	default:
+		return RawProtocol{}
+	}
+}
+
 func main() {
+	protocolFlag := flag.String("protocol", "raw", "default protocol for clients that don't announce themselves: raw, irc or framed")
+	adminIPsFlag := flag.String("admin-ips", "", "comma-separated IPs allowed to issue /ban, /unban, /banlist and /howtoban")
+	adminTokenFlag := flag.String("admin-token", "", "a client name that, if used, is treated as an admin regardless of IP")
+	logLevelFlag := flag.String("log-level", "info", "log level: debug, info, warn or error")
+	devFlag := flag.Bool("dev", false, "use console-formatted logs instead of JSON")
+	flag.BoolVar(&debugMode, "debug", false, "log every inbound/outbound message payload with byte length and UTF-8 validity")
+	flag.Parse()
+
+	l, err := New(LoggerConfig{Dev: *devFlag, LogLevel: *logLevelFlag, Debug: debugMode})
+	if err != nil {
+		panic(err)
+	}
+	logger = l
+	defer logger.Sync()
+
+	defaultProtocol := defaultProtocolFor(*protocolFlag)
+
+	admin := AdminConfig{IPs: map[string]bool{}, Token: *adminTokenFlag}
+	for _, ip := range strings.Split(*adminIPsFlag, ",") {
+		if ip = strings.TrimSpace(ip); ip != "" {
+			admin.IPs[ip] = true
+		}
+	}
+	banList := NewBanList(BanListFile)
+	strikes := NewStrikes()
+	rateLimiter := NewRateLimiter()
+
 	ln, err := net.Listen("tcp", ":"+Port)
 	if err != nil {
-		log.Fatalf("ERROR: could not listen to port %v: %s\n", Port, err)
+		logger.Fatal("could not listen", zap.String("port", Port), zap.Error(err))
 	}
-	log.Printf("listening to tcp connection on port %s \n", Port)
+	logger.Info("listening for tcp connections", zap.String("port", Port))
 
 	messages := make(chan Message)
-	go server(messages)
+	var wg sync.WaitGroup
+	go server(messages, banList, strikes, admin, &wg, rateLimiter)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		logger.Info("received shutdown signal", zap.Stringer("signal", sig))
+		ln.Close()
+		messages <- Message{Type: ServerShutdown}
+	}()
 
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			log.Printf("ERROR: could not accept the connection: %s\n", err)
-		}
-		messages <- Message{
-			Type: ClientConnected,
-			Conn: conn,
+			if errors.Is(err, net.ErrClosed) {
+				break
+			}
+			logger.Warn("could not accept connection", zap.Error(err))
+			continue
 		}
 
-		go client(conn, messages)
+		wg.Add(1)
+		go client(conn, messages, defaultProtocol, &wg)
 	}
 
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		logger.Info("all clients drained, shutting down")
+	case <-time.After(ShutdownTimeout):
+		logger.Warn("shutdown timed out waiting for clients", zap.Duration("timeout", ShutdownTimeout))
+	}
 }
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// CommandKind identifies what a client asked the server to do, independent
+// of which wire protocol it arrived over.
+type CommandKind int
+
+const (
+	CmdChat CommandKind = iota + 1
+	CmdJoin
+	CmdPart
+	CmdPing
+	CmdPong
+	CmdQuit
+	CmdNames
+	CmdWallops
+)
+
+// Command is the protocol-agnostic result of decoding one client message.
+type Command struct {
+	Kind    CommandKind
+	Channel string
+	Text    string
+}
+
+// Reply is what the server hands back to a Protocol to render on the wire.
+// Numeric is 0 for a plain chat line and a standard IRC numeric (001, 353,
+// ...) for a server reply.
+type Reply struct {
+	From    string
+	Channel string
+	Text    string
+	Numeric int
+}
+
+// ProtocolError is returned by Protocol.Decode for a malformed or
+// unsupported message that should be reported back to the client (with a
+// numeric reply) rather than tearing down the connection. Anything Decode
+// returns that isn't a *ProtocolError is treated as a fatal transport
+// error instead.
+type ProtocolError struct {
+	Numeric int
+	Text    string
+}
+
+func (e *ProtocolError) Error() string { return e.Text }
+
+// Protocol abstracts the wire format a client speaks, so server() can stay
+// agnostic of whether it's talking to a raw line-oriented chat client or a
+// real IRC client.
+type Protocol interface {
+	// Handshake performs whatever initial exchange is needed to learn the
+	// client's name ("Enter your name: " for Raw, NICK/USER for IRC). It
+	// reads from the same buffered reader Decode will later use, so bytes
+	// peeked during protocol detection aren't lost.
+	Handshake(r *bufio.Reader, conn net.Conn) (name string, err error)
+	// Decode reads and parses the next complete message from conn.
+	Decode(r *bufio.Reader) (Command, error)
+	// Encode writes a reply to w in this protocol's wire format. w is
+	// usually a buffer rather than the connection itself, so the caller can
+	// hand the encoded bytes to a client's writebuffer.
+	Encode(w io.Writer, reply Reply) error
+}
+
+// RawProtocol is the original ad-hoc "enter your name, then one line per
+// message" flow, kept as-is for clients that don't speak IRC.
+type RawProtocol struct{}
+
+func (RawProtocol) Handshake(r *bufio.Reader, conn net.Conn) (string, error) {
+	conn.Write([]byte("Enter your name: "))
+	buf := make([]byte, 20)
+	n, err := r.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return cleanName(string(buf[:n])), nil
+}
+
+func (RawProtocol) Decode(r *bufio.Reader) (Command, error) {
+	buf := make([]byte, 64)
+	n, err := r.Read(buf)
+	if err != nil {
+		return Command{}, err
+	}
+	return Command{Kind: CmdChat, Text: string(buf[:n])}, nil
+}
+
+func (RawProtocol) Encode(w io.Writer, reply Reply) error {
+	if reply.Numeric != 0 {
+		return nil
+	}
+	_, err := fmt.Fprintf(w, "%s: %s", reply.From, reply.Text)
+	return err
+}
+
+// IRCProtocol speaks a minimal RFC1459/2812-compatible subset: NICK, USER,
+// JOIN, PART, PRIVMSG, NOTICE, PING/PONG, QUIT, NAMES and WALLOPS, replying
+// in the standard ":prefix CMD params :trailing" wire format.
+type IRCProtocol struct {
+	serverName string
+}
+
+func NewIRCProtocol() *IRCProtocol {
+	return &IRCProtocol{serverName: "chat.local"}
+}
+
+func (p *IRCProtocol) Handshake(r *bufio.Reader, conn net.Conn) (string, error) {
+	var nick string
+	for nick == "" {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd, params := splitIRCLine(line)
+		switch strings.ToUpper(cmd) {
+		case "NICK":
+			if len(params) > 0 {
+				nick = cleanName(params[0])
+			}
+		case "USER":
+			// USER is accepted but the nick from NICK wins the name.
+		}
+	}
+	fmt.Fprintf(conn, ":%s 001 %s :Welcome to the server\r\n", p.serverName, nick)
+	return nick, nil
+}
+
+func (p *IRCProtocol) Decode(r *bufio.Reader) (Command, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return Command{}, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	cmd, params := splitIRCLine(line)
+	switch strings.ToUpper(cmd) {
+	case "PRIVMSG", "NOTICE":
+		if len(params) < 2 {
+			return Command{}, &ProtocolError{Numeric: 461, Text: fmt.Sprintf("%s :Not enough parameters", cmd)}
+		}
+		return Command{Kind: CmdChat, Channel: params[0], Text: params[1]}, nil
+	case "JOIN":
+		if len(params) < 1 {
+			return Command{}, &ProtocolError{Numeric: 461, Text: "JOIN :Not enough parameters"}
+		}
+		return Command{Kind: CmdJoin, Channel: params[0]}, nil
+	case "PART":
+		if len(params) < 1 {
+			return Command{}, &ProtocolError{Numeric: 461, Text: "PART :Not enough parameters"}
+		}
+		return Command{Kind: CmdPart, Channel: params[0]}, nil
+	case "PING":
+		text := ""
+		if len(params) > 0 {
+			text = params[0]
+		}
+		return Command{Kind: CmdPing, Text: text}, nil
+	case "PONG":
+		return Command{Kind: CmdPong}, nil
+	case "NAMES":
+		channel := ""
+		if len(params) > 0 {
+			channel = params[0]
+		}
+		return Command{Kind: CmdNames, Channel: channel}, nil
+	case "WALLOPS":
+		text := ""
+		if len(params) > 0 {
+			text = params[0]
+		}
+		return Command{Kind: CmdWallops, Text: text}, nil
+	case "QUIT":
+		return Command{Kind: CmdQuit}, nil
+	default:
+		// Real clients routinely send CAP, MODE, WHO and the like right
+		// after registering; reply with 401 rather than disconnecting
+		// over a command we just don't implement.
+		return Command{}, &ProtocolError{Numeric: 401, Text: fmt.Sprintf("%s :Unknown command", cmd)}
+	}
+}
+
+func (p *IRCProtocol) Encode(w io.Writer, reply Reply) error {
+	if reply.Numeric != 0 {
+		_, err := fmt.Fprintf(w, ":%s %03d %s\r\n", p.serverName, reply.Numeric, reply.Text)
+		return err
+	}
+	target := reply.Channel
+	if target == "" {
+		target = reply.From
+	}
+	_, err := fmt.Fprintf(w, ":%s PRIVMSG %s :%s\r\n", reply.From, target, reply.Text)
+	return err
+}
+
+// splitIRCLine splits a line into its command and params, honouring the
+// ":trailing" convention where everything after a leading ':' on the last
+// param is one argument including spaces.
+func splitIRCLine(line string) (cmd string, params []string) {
+	if trailing := strings.SplitN(line, " :", 2); len(trailing) == 2 {
+		fields := strings.Fields(trailing[0])
+		if len(fields) == 0 {
+			return "", []string{trailing[1]}
+		}
+		return fields[0], append(fields[1:], trailing[1])
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", nil
+	}
+	return fields[0], fields[1:]
+}
+
+// detectProtocolTimeout bounds how long detectProtocol waits for a client
+// to announce itself before giving up and falling back. A client speaking
+// fallback's protocol (e.g. Raw) may be waiting on the server to speak
+// first (the "Enter your name: " prompt), so Peek can't be allowed to
+// block indefinitely on it. It's generous enough to tolerate real
+// inter-continental/mobile round trips so a slow-but-legitimate IRC client
+// doesn't get misclassified as the fallback protocol for its whole session.
+const detectProtocolTimeout = 250 * time.Millisecond
+
+// detectProtocol peeks at the first bytes a client sends to tell an IRC
+// client (which opens with NICK/USER) apart from a raw one, without
+// blocking past detectProtocolTimeout for bytes that may never come
+// before the handshake speaks first.
+func detectProtocol(conn net.Conn, r *bufio.Reader, fallback Protocol) (Protocol, error) {
+	conn.SetReadDeadline(time.Now().Add(detectProtocolTimeout))
+	peek, err := r.Peek(4)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return fallback, nil
+		}
+		if len(peek) == 0 {
+			return fallback, err
+		}
+	}
+	prefix := strings.ToUpper(string(peek))
+	if strings.HasPrefix(prefix, "NICK") || strings.HasPrefix(prefix, "USER") {
+		return NewIRCProtocol(), nil
+	}
+	return fallback, nil
+}
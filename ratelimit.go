@@ -0,0 +1,100 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// RateLimitBurst is the largest number of messages a client can send
+	// back-to-back before being throttled.
+	RateLimitBurst = 5.0
+	// RateLimitPerSecond is how many tokens a bucket refills per second
+	// once it's below RateLimitBurst.
+	RateLimitPerSecond = 1.0
+	// MaxConnectionsPerIP caps how many concurrent connections one IP may
+	// hold open at once.
+	MaxConnectionsPerIP = 5
+	// BucketIdleTimeout is how long a bucket can go untouched before GC
+	// drops it.
+	BucketIdleTimeout = 10 * time.Minute
+)
+
+// bucket is one IP's token bucket: tokens refill lazily, computed from the
+// time elapsed since the bucket was last touched rather than a background
+// goroutine per IP.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter enforces a token-bucket message rate and a concurrent
+// connection cap, both keyed by IP so reconnect-spam and connection-storms
+// are throttled along with flooding from a single connection.
+type RateLimiter struct {
+	buckets     map[string]*bucket
+	connections map[string]int
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		buckets:     map[string]*bucket{},
+		connections: map[string]int{},
+	}
+}
+
+// Allow reports whether ip currently has a token to spend, consuming one if
+// it does.
+func (rl *RateLimiter) Allow(ip string) bool {
+	now := time.Now()
+	b, ok := rl.buckets[ip]
+	if !ok {
+		b = &bucket{tokens: RateLimitBurst, last: now}
+		rl.buckets[ip] = b
+	}
+	b.tokens = math.Min(RateLimitBurst, b.tokens+now.Sub(b.last).Seconds()*RateLimitPerSecond)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Connect records a new connection from ip, returning false (without
+// recording it) if ip is already at MaxConnectionsPerIP.
+func (rl *RateLimiter) Connect(ip string) bool {
+	if rl.connections[ip] >= MaxConnectionsPerIP {
+		return false
+	}
+	rl.connections[ip]++
+	return true
+}
+
+// Disconnect records that one of ip's connections has closed.
+func (rl *RateLimiter) Disconnect(ip string) {
+	if rl.connections[ip] <= 1 {
+		delete(rl.connections, ip)
+		return
+	}
+	rl.connections[ip]--
+}
+
+// GC drops buckets that haven't been touched in over BucketIdleTimeout.
+func (rl *RateLimiter) GC() {
+	now := time.Now()
+	for ip, b := range rl.buckets {
+		if now.Sub(b.last) > BucketIdleTimeout {
+			delete(rl.buckets, ip)
+		}
+	}
+}
+
+// Stats summarizes the rate limiter's live state for the /stats admin
+// command.
+func (rl *RateLimiter) Stats() (trackedIPs, totalConnections int) {
+	for _, n := range rl.connections {
+		totalConnections += n
+	}
+	return len(rl.buckets), totalConnections
+}
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestRateLimiterAllowBurstThenThrottles(t *testing.T) {
+	rl := NewRateLimiter()
+	for i := 0; i < int(RateLimitBurst); i++ {
+		if !rl.Allow("1.2.3.4") {
+			t.Fatalf("expected burst token %d to be allowed", i)
+		}
+	}
+	if rl.Allow("1.2.3.4") {
+		t.Fatalf("expected the bucket to be empty after spending the whole burst")
+	}
+}
+
+func TestRateLimiterConnectEnforcesPerIPCap(t *testing.T) {
+	rl := NewRateLimiter()
+	for i := 0; i < MaxConnectionsPerIP; i++ {
+		if !rl.Connect("1.2.3.4") {
+			t.Fatalf("expected connection %d to be allowed", i)
+		}
+	}
+	if rl.Connect("1.2.3.4") {
+		t.Fatalf("expected the connection cap to reject a connection beyond MaxConnectionsPerIP")
+	}
+
+	rl.Disconnect("1.2.3.4")
+	if !rl.Connect("1.2.3.4") {
+		t.Fatalf("expected a slot to free up after Disconnect")
+	}
+}